@@ -0,0 +1,120 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+
+// fakeConn is a minimal io.ReadWriter: reads come from a pre-filled
+// buffer (standing in for bytes already on the wire from a peer),
+// writes land in a separate buffer so the test can inspect what the
+// channel sent back.
+type fakeConn struct {
+	in  *bytes.Buffer
+	out bytes.Buffer
+}
+
+func (f *fakeConn) Read(p []byte) (int, os.Error)  { return f.in.Read(p) }
+func (f *fakeConn) Write(p []byte) (int, os.Error) { return f.out.Write(p) }
+
+
+func wantMsize(t *testing.T, want int32) *fakeConn {
+	var in bytes.Buffer
+	binary.Write(&in, binary.BigEndian, want)
+	return &fakeConn{in: &in}
+}
+
+func readBackMsize(t *testing.T, f *fakeConn) int32 {
+	var got int32
+	if err := binary.Read(&f.out, binary.BigEndian, &got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+
+func TestChannelDefaultMSize(t *testing.T) {
+	ch := NewChannel()
+	if ch.MSize() != defaultMsize {
+		t.Errorf("MSize() = %d, want %d", ch.MSize(), defaultMsize)
+	}
+}
+
+
+func TestChannelSetMSize(t *testing.T) {
+	ch := NewChannel()
+	ch.SetMSize(64)
+	if ch.MSize() != 64 {
+		t.Errorf("MSize() = %d, want 64", ch.MSize())
+	}
+}
+
+
+func TestErrMsgTooLargeString(t *testing.T) {
+	err := &ErrMsgTooLarge{Size: 100, MSize: 64}
+	s := err.String()
+	if s == "" {
+		t.Fatal("String() returned empty string")
+	}
+}
+
+
+// TestNegotiateAdoptsClientRequestWithinMax checks the normal case: the
+// client asks for less than max, the channel grants exactly that and
+// echoes it back.
+func TestNegotiateAdoptsClientRequestWithinMax(t *testing.T) {
+	f := wantMsize(t, 1500)
+
+	ch := NewChannel()
+	if err := ch.Negotiate(f, 3000); err != nil {
+		t.Fatal(err)
+	}
+
+	if ch.MSize() != 1500 {
+		t.Errorf("MSize() = %d, want 1500", ch.MSize())
+	}
+	if got := readBackMsize(t, f); got != 1500 {
+		t.Errorf("echoed msize = %d, want 1500", got)
+	}
+}
+
+
+// TestNegotiateClampsRequestAboveMax checks that a client asking for
+// more than the server allows is clamped down, and the clamp (not the
+// request) is what gets echoed back and adopted.
+func TestNegotiateClampsRequestAboveMax(t *testing.T) {
+	f := wantMsize(t, 1<<20)
+
+	ch := NewChannel()
+	if err := ch.Negotiate(f, 3000); err != nil {
+		t.Fatal(err)
+	}
+
+	if ch.MSize() != 3000 {
+		t.Errorf("MSize() = %d, want 3000 (clamped to max)", ch.MSize())
+	}
+	if got := readBackMsize(t, f); got != 3000 {
+		t.Errorf("echoed msize = %d, want 3000", got)
+	}
+}
+
+
+// TestNegotiateClampsNonPositiveRequest checks that a zero or negative
+// request (e.g. an old client's first 4 frame-length bytes happening to
+// decode that way) falls back to max rather than producing a zero or
+// negative MSize.
+func TestNegotiateClampsNonPositiveRequest(t *testing.T) {
+	f := wantMsize(t, 0)
+
+	ch := NewChannel()
+	if err := ch.Negotiate(f, 3000); err != nil {
+		t.Fatal(err)
+	}
+
+	if ch.MSize() != 3000 {
+		t.Errorf("MSize() = %d, want 3000", ch.MSize())
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bufio"
+	"doozer/proto"
+	"io"
+	"os"
+)
+
+
+// Codec turns bytes on the wire into *T requests and *R responses back
+// into bytes. protoCodec is the original doozer wire format; jsonCodec
+// lets third-party tools speak plain JSON-RPC instead.
+type Codec interface {
+	ReadRequest(r io.Reader) (*T, os.Error)
+	WriteResponse(w io.Writer, resp *R) os.Error
+}
+
+
+// sniffCodec is the default CodecFactory: '{' selects JSON-RPC,
+// anything else keeps the original protobuf framing.
+func sniffCodec(first byte) Codec {
+	if first == '{' {
+		return &jsonCodec{}
+	}
+	return newProtoCodec()
+}
+
+
+// negotiateCodec peeks the first byte to choose a Codec without
+// consuming it, then runs the msize handshake for the protobuf codec.
+func (c *conn) negotiateCodec() os.Error {
+	br := bufio.NewReader(c.c)
+	b, err := br.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	factory := c.s.CodecFactory
+	if factory == nil {
+		factory = sniffCodec
+	}
+
+	c.codec = factory(b[0])
+	c.c = bufReadWriter{br, c.c}
+
+	if pc, ok := c.codec.(*protoCodec); ok {
+		return pc.ch.Negotiate(c.c, c.s.maxMsize())
+	}
+	return nil
+}
+
+
+// bufReadWriter pairs a buffered Reader (holding look-ahead bytes from
+// codec sniffing) with the original connection's Writer.
+type bufReadWriter struct {
+	r io.Reader
+	w io.Writer
+}
+
+
+func (b bufReadWriter) Read(p []byte) (int, os.Error)  { return b.r.Read(p) }
+func (b bufReadWriter) Write(p []byte) (int, os.Error) { return b.w.Write(p) }
+
+
+// protoCodec adapts a proto.Channel, which frames doozer's original
+// length-prefixed protobuf messages, to the server-local T/R types.
+type protoCodec struct {
+	ch *proto.Channel
+}
+
+
+func newProtoCodec() *protoCodec {
+	return &protoCodec{proto.NewChannel()}
+}
+
+
+func (c *protoCodec) ReadRequest(r io.Reader) (*T, os.Error) {
+	var req proto.Request
+	if err := c.ch.ReadRequest(r, &req); err != nil {
+		return nil, err
+	}
+	return (*T)(&req), nil
+}
+
+
+func (c *protoCodec) WriteResponse(w io.Writer, resp *R) os.Error {
+	return c.ch.WriteResponse(w, (*proto.Response)(resp))
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"doozer/proto"
+	"encoding/binary"
+	"json"
+	"testing"
+
+	pb "goprotobuf.googlecode.com/hg/proto"
+)
+
+
+// encodeProtoRequest hand-rolls the length-prefixed wire form a real
+// doozer client would send, independent of protoCodec itself.
+func encodeProtoRequest(t *testing.T, req *T) []byte {
+	buf, err := pb.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.BigEndian, int32(len(buf)))
+	out.Write(buf)
+	return out.Bytes()
+}
+
+
+// encodeJSONRequest hand-rolls the JSON-RPC form a third-party client
+// would send, independent of jsonCodec itself.
+func encodeJSONRequest(t *testing.T, method string, tag int32, path string, rev int64) []byte {
+	buf, err := json.Marshal(&jsonRequest{
+		Method: method,
+		Id:     tag,
+		Params: &jsonReqParams{Path: &path, Rev: &rev},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+
+// TestCodecsAgreeOnGet is a conformance check that the JSON-RPC and
+// protobuf codecs decode the wire form of the same logical GET request
+// into the same *T, i.e. neither codec should change op behavior, only
+// wire format.
+func TestCodecsAgreeOnGet(t *testing.T) {
+	path := "/foo"
+	rev := int64(42)
+
+	wires := map[Codec][]byte{
+		newProtoCodec(): encodeProtoRequest(t, &T{
+			Verb: (*proto.Request_Verb)(pb.Int32(proto.Request_GET)),
+			Tag:  pb.Int32(7),
+			Path: &path,
+			Rev:  &rev,
+		}),
+		&jsonCodec{}: encodeJSONRequest(t, "GET", 7, path, rev),
+	}
+
+	for codec, wire := range wires {
+		got, err := codec.ReadRequest(bytes.NewBuffer(wire))
+		if err != nil {
+			t.Fatalf("%T: decode request: %s", codec, err)
+		}
+
+		if pb.GetInt32((*int32)(got.Verb)) != proto.Request_GET {
+			t.Errorf("%T: verb = %v, want GET", codec, got.Verb)
+		}
+		if pb.GetInt32(got.Tag) != 7 {
+			t.Errorf("%T: tag = %d, want 7", codec, pb.GetInt32(got.Tag))
+		}
+		if pb.GetString(got.Path) != path {
+			t.Errorf("%T: path = %q, want %q", codec, pb.GetString(got.Path), path)
+		}
+		if pb.GetInt64(got.Rev) != rev {
+			t.Errorf("%T: rev = %d, want %d", codec, pb.GetInt64(got.Rev), rev)
+		}
+	}
+}
+
+
+// TestCodecsAgreeOnResponse checks that a final response round-trips
+// through both codecs with the same rev and Done flag.
+func TestCodecsAgreeOnResponse(t *testing.T) {
+	rev := int64(9)
+	resp := &R{
+		Tag:   pb.Int32(7),
+		Flags: pb.Int32(Valid | Done),
+		Rev:   &rev,
+	}
+
+	for _, codec := range []Codec{newProtoCodec(), &jsonCodec{}} {
+		var wire bytes.Buffer
+		if err := codec.WriteResponse(&wire, resp); err != nil {
+			t.Fatalf("%T: encode response: %s", codec, err)
+		}
+		if wire.Len() == 0 {
+			t.Errorf("%T: wrote zero bytes for a response", codec)
+		}
+
+		var gotRev int64
+		var gotFlags int32
+		switch codec.(type) {
+		case *protoCodec:
+			var size int32
+			binary.Read(&wire, binary.BigEndian, &size)
+			var got proto.Response
+			if err := pb.Unmarshal(wire.Bytes(), &got); err != nil {
+				t.Fatalf("%T: decode response: %s", codec, err)
+			}
+			gotRev, gotFlags = pb.GetInt64(got.Rev), pb.GetInt32(got.Flags)
+		case *jsonCodec:
+			var got jsonResponse
+			if err := json.Unmarshal(wire.Bytes(), &got); err != nil || got.Result == nil {
+				t.Fatalf("%T: decode response: %v (result %v)", codec, err, got.Result)
+			}
+			gotRev, gotFlags = pb.GetInt64(got.Result.Rev), got.Result.Flags
+		}
+		if gotRev != rev {
+			t.Errorf("%T: rev = %d, want %d", codec, gotRev, rev)
+		}
+		if gotFlags != Valid|Done {
+			t.Errorf("%T: flags = %d, want %d (Valid|Done)", codec, gotFlags, Valid|Done)
+		}
+	}
+}
+
+
+// TestJSONCodecTagsStreamedNotifications checks that a non-final
+// response (e.g. one of several WATCH notifications) still carries its
+// tag, so a client with more than one multi-response op outstanding can
+// tell which op a given notification belongs to before the op's final
+// (Done) message arrives.
+func TestJSONCodecTagsStreamedNotifications(t *testing.T) {
+	rev := int64(1)
+	c := &jsonCodec{}
+
+	var wire bytes.Buffer
+	notify := &R{Tag: pb.Int32(11), Flags: pb.Int32(Valid), Rev: &rev}
+	if err := c.WriteResponse(&wire, notify); err != nil {
+		t.Fatalf("encode streamed notification: %s", err)
+	}
+
+	var got jsonResponse
+	if err := json.Unmarshal(wire.Bytes(), &got); err != nil {
+		t.Fatalf("decode streamed notification: %s", err)
+	}
+	if got.Id == nil || *got.Id != 11 {
+		t.Fatalf("Id = %v, want 11", got.Id)
+	}
+
+	wire.Reset()
+	other := &R{Tag: pb.Int32(12), Flags: pb.Int32(Valid), Rev: &rev}
+	if err := c.WriteResponse(&wire, other); err != nil {
+		t.Fatalf("encode second tag's notification: %s", err)
+	}
+	if err := json.Unmarshal(wire.Bytes(), &got); err != nil {
+		t.Fatalf("decode second tag's notification: %s", err)
+	}
+	if got.Id == nil || *got.Id != 12 {
+		t.Fatalf("Id = %v, want 12 (must not reuse the first tag)", got.Id)
+	}
+}
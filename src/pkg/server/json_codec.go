@@ -0,0 +1,148 @@
+package server
+
+import (
+	"doozer/proto"
+	"io"
+	"json"
+	"os"
+
+	pb "goprotobuf.googlecode.com/hg/proto"
+)
+
+
+// verbNames maps Request_Verb values to the JSON-RPC method name used on
+// the wire, and back. Kept in sync with the ops table in server.go.
+var verbNames = map[int32]string{
+	proto.Request_CANCEL: "CANCEL",
+	proto.Request_DEL:    "DEL",
+	proto.Request_GET:    "GET",
+	proto.Request_GETDIR: "GETDIR",
+	proto.Request_NOP:    "NOP",
+	proto.Request_REV:    "REV",
+	proto.Request_SET:    "SET",
+	proto.Request_STAT:   "STAT",
+	proto.Request_WALK:   "WALK",
+	proto.Request_WATCH:  "WATCH",
+}
+
+var verbsByName map[string]int32
+
+func init() {
+	verbsByName = make(map[string]int32, len(verbNames))
+	for v, name := range verbNames {
+		verbsByName[name] = v
+	}
+}
+
+
+// jsonRequest is a JSON-RPC 2.0 request/notification. Params mirror the
+// fields of proto.Request that each verb actually uses.
+type jsonRequest struct {
+	Method string         `json:"method"`
+	Params *jsonReqParams `json:"params"`
+	Id     int32          `json:"id"`
+}
+
+type jsonReqParams struct {
+	Path     *string `json:"path"`
+	Value    []byte  `json:"value"`
+	Rev      *int64  `json:"rev"`
+	Offset   *int32  `json:"offset"`
+	Limit    *int32  `json:"limit"`
+	OtherTag *int32  `json:"otherTag"`
+}
+
+
+// jsonResponse is a JSON-RPC 2.0 response. Id always carries the
+// request's tag, even for the non-final messages of a multi-response
+// op (WATCH, WALK, GETDIR), so a client can demux concurrent ops.
+type jsonResponse struct {
+	Id     *int32          `json:"id,omitempty"`
+	Result *jsonRespResult `json:"result,omitempty"`
+	Error  *jsonRPCError   `json:"error,omitempty"`
+}
+
+type jsonRespResult struct {
+	Path  *string `json:"path,omitempty"`
+	Value []byte  `json:"value,omitempty"`
+	Rev   *int64  `json:"rev,omitempty"`
+	Len   *int64  `json:"len,omitempty"`
+	Flags int32   `json:"flags"`
+}
+
+type jsonRPCError struct {
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
+}
+
+
+// jsonCodec is a JSON-RPC 2.0 front-end for the same T/R request and
+// response types the protobuf codec uses, so every op behaves
+// identically regardless of which codec a client connects with.
+type jsonCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+}
+
+
+func (c *jsonCodec) ReadRequest(r io.Reader) (*T, os.Error) {
+	if c.dec == nil {
+		c.dec = json.NewDecoder(r)
+	}
+
+	var jr jsonRequest
+	if err := c.dec.Decode(&jr); err != nil {
+		return nil, err
+	}
+
+	verb, ok := verbsByName[jr.Method]
+	if !ok {
+		verb = -1 // readBuf's caller maps unknown verbs to UNKNOWN_VERB
+	}
+
+	t := &T{
+		Verb: (*proto.Request_Verb)(&verb),
+		Tag:  pb.Int32(jr.Id),
+	}
+
+	if jr.Params != nil {
+		t.Path = jr.Params.Path
+		t.Value = jr.Params.Value
+		t.Rev = jr.Params.Rev
+		t.Offset = jr.Params.Offset
+		t.Limit = jr.Params.Limit
+		t.OtherTag = jr.Params.OtherTag
+	}
+
+	return t, nil
+}
+
+
+func (c *jsonCodec) WriteResponse(w io.Writer, resp *R) os.Error {
+	if c.enc == nil {
+		c.enc = json.NewEncoder(w)
+	}
+
+	jr := &jsonResponse{}
+
+	flags := pb.GetInt32(resp.Flags)
+	tag := pb.GetInt32(resp.Tag)
+	jr.Id = &tag
+
+	if resp.ErrCode != nil {
+		jr.Error = &jsonRPCError{
+			Code:    int32(*resp.ErrCode),
+			Message: pb.GetString(resp.ErrDetail),
+		}
+	} else {
+		jr.Result = &jsonRespResult{
+			Path:  resp.Path,
+			Value: resp.Value,
+			Rev:   resp.Rev,
+			Len:   resp.Len,
+			Flags: flags,
+		}
+	}
+
+	return c.enc.Encode(jr)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"syslog"
+)
+
+
+// Logger receives structured events from a Server: accept errors,
+// marshal/write failures, poisoned connections, and failed proposals
+// from this package's own best-effort consensus.Set calls (see
+// conn.setLogged). kv is alternating key/value pairs, e.g.
+// ("conn.addr", c.addr, "tag", tag, "err", err).
+//
+// TODO: doesn't yet cover paxos accept/propose failures that originate
+// inside doozer/consensus itself; that package has no hook to route
+// through a Logger.
+type Logger interface {
+	Info(event string, kv ...interface{})
+	Warn(event string, kv ...interface{})
+	Error(event string, kv ...interface{})
+}
+
+
+// stdLogger is the default Logger: it preserves the server's original
+// behavior of writing one line per event via the standard log package.
+type stdLogger struct{}
+
+
+func (stdLogger) Info(event string, kv ...interface{})  { stdLog("INFO", event, kv) }
+func (stdLogger) Warn(event string, kv ...interface{})  { stdLog("WARN", event, kv) }
+func (stdLogger) Error(event string, kv ...interface{}) { stdLog("ERROR", event, kv) }
+
+
+func stdLog(level, event string, kv []interface{}) {
+	log.Println(level, event, formatKV(kv))
+}
+
+
+// formatKV renders alternating key/value pairs as "k=v k2=v2 ...". An
+// odd trailing key with no value is rendered as "k=?".
+func formatKV(kv []interface{}) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		if i+1 < len(kv) {
+			fmt.Fprintf(&buf, "%s=%v", kv[i], kv[i+1])
+		} else {
+			fmt.Fprintf(&buf, "%v=?", kv[i])
+		}
+	}
+	return buf.String()
+}
+
+
+// syslogLogger ships events to a local or remote syslog daemon, one
+// line per event.
+type syslogLogger struct {
+	w *syslog.Writer
+}
+
+
+// NewSyslogLogger dials a syslog daemon. network and raddr follow
+// net.Dial conventions (e.g. "udp", "log-host:514"); pass "" for
+// network to log to the local syslog instead.
+func NewSyslogLogger(network, raddr, tag string) (Logger, os.Error) {
+	var w *syslog.Writer
+	var err os.Error
+	if network == "" {
+		w, err = syslog.New(syslog.LOG_INFO, tag)
+	} else {
+		w, err = syslog.Dial(network, raddr, syslog.LOG_INFO, tag)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &syslogLogger{w}, nil
+}
+
+
+func (l *syslogLogger) Info(event string, kv ...interface{}) {
+	l.w.Info(event + " " + formatKV(kv))
+}
+
+
+func (l *syslogLogger) Warn(event string, kv ...interface{}) {
+	l.w.Warning(event + " " + formatKV(kv))
+}
+
+
+func (l *syslogLogger) Error(event string, kv ...interface{}) {
+	l.w.Err(event + " " + formatKV(kv))
+}
+
+
+func (s *Server) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return stdLogger{}
+}
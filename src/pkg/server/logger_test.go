@@ -0,0 +1,115 @@
+package server
+
+import (
+	"doozer/proto"
+	"io"
+	"os"
+	"testing"
+
+	pb "goprotobuf.googlecode.com/hg/proto"
+)
+
+
+type loggedCall struct {
+	level string
+	event string
+	kv    []interface{}
+}
+
+type fakeLogger struct {
+	calls []loggedCall
+}
+
+func (l *fakeLogger) Info(event string, kv ...interface{})  { l.log("INFO", event, kv) }
+func (l *fakeLogger) Warn(event string, kv ...interface{})  { l.log("WARN", event, kv) }
+func (l *fakeLogger) Error(event string, kv ...interface{}) { l.log("ERROR", event, kv) }
+
+func (l *fakeLogger) log(level, event string, kv []interface{}) {
+	l.calls = append(l.calls, loggedCall{level, event, kv})
+}
+
+
+// failingCodec always fails ReadRequest/WriteResponse with a fixed error,
+// to exercise the conn's error-logging paths without a real socket.
+type failingCodec struct {
+	readErr  os.Error
+	writeErr os.Error
+}
+
+func (c failingCodec) ReadRequest(r io.Reader) (*T, os.Error) {
+	return nil, c.readErr
+}
+
+func (c failingCodec) WriteResponse(w io.Writer, resp *R) os.Error {
+	return c.writeErr
+}
+
+
+func TestServeLogsMalformedFrame(t *testing.T) {
+	fl := &fakeLogger{}
+	s := &Server{Logger: fl}
+	c := &conn{s: s, addr: "1.2.3.4:5", tx: make(map[int32]txn), codec: failingCodec{readErr: os.NewError("bad frame")}}
+
+	c.serve()
+
+	if len(fl.calls) != 1 {
+		t.Fatalf("got %d log calls, want 1: %+v", len(fl.calls), fl.calls)
+	}
+	if fl.calls[0].event != "read-request" {
+		t.Errorf("event = %q, want read-request", fl.calls[0].event)
+	}
+}
+
+
+func TestServeDoesNotLogCleanEOF(t *testing.T) {
+	fl := &fakeLogger{}
+	s := &Server{Logger: fl}
+	c := &conn{s: s, addr: "1.2.3.4:5", tx: make(map[int32]txn), codec: failingCodec{readErr: os.EOF}}
+
+	c.serve()
+
+	if len(fl.calls) != 0 {
+		t.Fatalf("got %d log calls on clean EOF, want 0: %+v", len(fl.calls), fl.calls)
+	}
+}
+
+
+func TestRespondLogsWriteFailureAsPoisoned(t *testing.T) {
+	fl := &fakeLogger{}
+	s := &Server{Logger: fl}
+	c := &conn{s: s, addr: "1.2.3.4:5", tx: make(map[int32]txn), codec: failingCodec{writeErr: os.NewError("broken pipe")}}
+
+	path := "/foo"
+	tag := pb.Int32(1)
+	reqT := &T{Tag: tag, Path: &path}
+
+	c.respond(reqT, Valid|Done, nil, &R{})
+
+	if !c.poisoned {
+		t.Fatal("expected conn to be marked poisoned after a write failure")
+	}
+	if len(fl.calls) != 1 || fl.calls[0].event != "poisoned" {
+		t.Fatalf("log calls = %+v, want one \"poisoned\" event", fl.calls)
+	}
+}
+
+
+func TestRespondDropsTooLargeResponseWithoutPoisoning(t *testing.T) {
+	fl := &fakeLogger{}
+	s := &Server{Logger: fl}
+	tooLarge := &proto.ErrMsgTooLarge{Size: 9000, MSize: 3000}
+	c := &conn{s: s, addr: "1.2.3.4:5", tx: make(map[int32]txn), codec: failingCodec{writeErr: tooLarge}}
+
+	path := "/foo"
+	tag := pb.Int32(1)
+	reqT := &T{Tag: tag, Path: &path}
+
+	c.respond(reqT, Valid|Done, nil, &R{})
+
+	if c.poisoned {
+		t.Fatal("expected conn to stay usable after an oversize response, not be poisoned")
+	}
+	if len(fl.calls) != 1 || fl.calls[0].event != "response-too-large" {
+		t.Fatalf("log calls = %+v, want one \"response-too-large\" event", fl.calls)
+	}
+}
@@ -1,12 +1,11 @@
 package server
 
 import (
+	"crypto/tls"
 	"doozer/consensus"
 	"doozer/proto"
 	"doozer/store"
-	"encoding/binary"
 	"io"
-	"log"
 	"math"
 	"net"
 	"os"
@@ -47,6 +46,10 @@ var (
 		ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
 		ErrDetail: pb.String("unknown tag"),
 	}
+	noSecureAddr = &R{
+		ErrCode:   proto.NewResponse_Err(proto.Response_OTHER),
+		ErrDetail: pb.String("no known secure address for leader"),
+	}
 )
 
 
@@ -91,6 +94,54 @@ type Server struct {
 	Self string
 
 	Alpha int64
+
+	// TLSConfig, when non-nil, causes Serve to wrap every accepted
+	// connection in a TLS server handshake before handing it to conn.serve.
+	// Set ClientAuth to tls.RequireAndVerifyClientCert and populate
+	// ClientCAs to require and verify client certificates.
+	TLSConfig *tls.Config
+
+	// WatchBufSize bounds the number of pending events buffered for a
+	// slow watch consumer, per conn.watch call. Zero means
+	// defaultWatchBufSize.
+	WatchBufSize int
+
+	// CodecFactory picks the wire Codec for a newly accepted connection
+	// given the first byte read from it, without consuming it. Nil means
+	// sniffCodec: '{' selects JSON-RPC, anything else selects the
+	// original length-prefixed protobuf framing.
+	CodecFactory func(first byte) Codec
+
+	// Logger receives structured events in place of the server's
+	// previous ad-hoc log.Println calls. Nil means stdLogger{}, which
+	// preserves the original behavior.
+	Logger Logger
+
+	// MaxMsize caps the msize a client can negotiate for a protobuf
+	// connection's proto.Channel. Zero means packetSize, the fixed
+	// limit doozerd used before msize was negotiable.
+	MaxMsize int
+}
+
+
+// defaultWatchBufSize is the ring buffer capacity used when
+// Server.WatchBufSize is unset.
+const defaultWatchBufSize = 1024
+
+
+func (s *Server) watchBufSize() int {
+	if s.WatchBufSize > 0 {
+		return s.WatchBufSize
+	}
+	return defaultWatchBufSize
+}
+
+
+func (s *Server) maxMsize() int {
+	if s.MaxMsize > 0 {
+		return s.MaxMsize
+	}
+	return packetSize
 }
 
 
@@ -104,7 +155,7 @@ func (s *Server) accept(l net.Listener, ch chan net.Conn) {
 			if e, ok := err.(*net.OpError); ok && e.Error == os.EINVAL {
 				break
 			}
-			log.Println(err)
+			s.logger().Error("accept", "err", err)
 			continue
 		}
 		ch <- c
@@ -123,14 +174,36 @@ func (s *Server) Serve(l net.Listener, cal chan bool) {
 			if closed(conns) {
 				return
 			}
+			addr := rw.RemoteAddr().String()
 			c := &conn{
 				c:    rw,
-				addr: rw.RemoteAddr().String(),
+				addr: addr,
 				s:    s,
 				cal:  w,
 				tx:   make(map[int32]txn),
 			}
+			if s.TLSConfig != nil {
+				tc := tls.Server(rw, s.TLSConfig)
+				c.c = tc
+				c.tlsConn = tc
+			}
 			go func() {
+				if c.tlsConn != nil {
+					if err := c.tlsConn.Handshake(); err != nil {
+						s.logger().Warn("tls-handshake", "conn.addr", addr, "err", err)
+						rw.Close()
+						return
+					}
+					state := c.tlsConn.ConnectionState()
+					c.tlsState = &state
+				}
+				if err := c.negotiateCodec(); err != nil {
+					if err != os.EOF {
+						s.logger().Warn("negotiate-codec", "conn.addr", addr, "err", err)
+					}
+					rw.Close()
+					return
+				}
 				c.serve()
 				rw.Close()
 			}()
@@ -207,6 +280,26 @@ type conn struct {
 	tx       map[int32]txn
 	tl       sync.Mutex // tx lock
 	poisoned bool
+
+	tlsConn  *tls.Conn
+	tlsState *tls.ConnectionState
+
+	codec Codec
+
+	lastActive int64     // ns, guarded by slk; touched by every request
+	sessDone   chan bool // closed when serve() returns, stops the lease keepalive
+}
+
+
+// ConnectionState returns the negotiated TLS state for this connection and
+// true, or the zero value and false if the connection is not using TLS.
+// Handlers can consult it (e.g. PeerCertificates[0].Subject) to make
+// ACL decisions.
+func (c *conn) ConnectionState() (tls.ConnectionState, bool) {
+	if c.tlsState == nil {
+		return tls.ConnectionState{}, false
+	}
+	return *c.tlsState, true
 }
 
 
@@ -225,42 +318,29 @@ var ops = map[int32]func(*conn, *T, txn){
 
 
 func (c *conn) readBuf() (*T, os.Error) {
-	var size int32
-	err := binary.Read(c.c, binary.BigEndian, &size)
-	if err != nil {
-		return nil, err
-	}
-
-	buf := make([]byte, size)
-	_, err = io.ReadFull(c.c, buf)
-	if err != nil {
-		return nil, err
-	}
-
-	var t T
-	err = pb.Unmarshal(buf, &t)
-	if err != nil {
-		return nil, err
-	}
-	return &t, nil
+	return c.codec.ReadRequest(c.c)
 }
 
 
 func (c *conn) serve() {
 	defer c.cancelAll()
+	defer c.closeSession()
 
 	for {
 		t, err := c.readBuf()
 		if err != nil {
 			if err != os.EOF {
-				log.Println(err)
+				c.s.logger().Warn("read-request", "conn.addr", c.addr, "err", err)
 			}
 			return
 		}
 
+		c.touchSession()
+
 		verb := pb.GetInt32((*int32)(t.Verb))
 		f, ok := ops[verb]
 		if !ok {
+			c.s.logger().Warn("unknown-verb", "conn.addr", c.addr, "tag", pb.GetInt32(t.Tag), "verb", verb)
 			var r R
 			r.ErrCode = proto.NewResponse_Err(proto.Response_UNKNOWN_VERB)
 			c.respond(t, Valid|Done, nil, &r)
@@ -307,44 +387,39 @@ func (c *conn) respond(t *T, flag int32, cc chan bool, r *R) {
 		return
 	}
 
-	buf, err := pb.Marshal(r)
 	c.wl.Lock()
 	defer c.wl.Unlock()
+
+	err := c.codec.WriteResponse(c.c, r)
 	if err != nil {
-		c.poisoned = true
-		select {
-		case cc <- true:
-		default:
+		if e, ok := err.(*proto.ErrMsgTooLarge); ok {
+			// The channel itself is still framed correctly; only this
+			// one response was too big to send. Drop it and keep the
+			// conn alive instead of poisoning it.
+			c.s.logger().Warn("response-too-large",
+				"conn.addr", c.addr,
+				"tag", tag,
+				"verb", pb.GetInt32((*int32)(t.Verb)),
+				"path", pb.GetString(t.Path),
+				"size", e.Size,
+				"msize", e.MSize)
+			return
 		}
-		log.Println(err)
-		return
-	}
 
-	err = binary.Write(c.c, binary.BigEndian, int32(len(buf)))
-	if err != nil {
 		c.poisoned = true
 		select {
 		case cc <- true:
 		default:
 		}
-		log.Println(err)
+		c.s.logger().Error("poisoned",
+			"conn.addr", c.addr,
+			"tag", tag,
+			"verb", pb.GetInt32((*int32)(t.Verb)),
+			"path", pb.GetString(t.Path),
+			"rev", pb.GetInt64(r.Rev),
+			"err", err)
 		return
 	}
-
-	for len(buf) > 0 {
-		n, err := c.c.Write(buf)
-		if err != nil {
-			c.poisoned = true
-			select {
-			case cc <- true:
-			default:
-			}
-			log.Println(err)
-			return
-		}
-
-		buf = buf[n:]
-	}
 }
 
 
@@ -356,8 +431,31 @@ func (c *conn) redirect(t *T) {
 	}
 
 	cal := cals[rand.Intn(len(cals))]
-	parts, rev := c.s.St.Get("/ctl/node/" + cal + "/addr")
-	if rev == store.Dir && rev == store.Missing {
+
+	// A client that came in over TLS must stay on a secure channel, so
+	// it's redirected to the leader's /ctl/node/<cal>/tls-addr, not its
+	// plaintext /ctl/node/<cal>/addr. Nothing in this package writes
+	// tls-addr -- that's the responsibility of node startup/registration
+	// code (outside this trimmed package) for any node whose Server has
+	// TLSConfig set. If that key is missing, the leader has no known
+	// secure address; rather than silently handing the client a
+	// plaintext address, fail the redirect so the client can retry
+	// instead of being downgraded without noticing.
+	key := "/ctl/node/" + cal + "/addr"
+	if c.tlsConn != nil {
+		key = "/ctl/node/" + cal + "/tls-addr"
+	}
+
+	parts, rev := c.s.St.Get(key)
+	if rev == store.Missing {
+		if c.tlsConn != nil {
+			c.respond(t, Valid|Done, nil, noSecureAddr)
+			return
+		}
+		c.respond(t, Valid|Done, nil, readonly)
+		return
+	}
+	if rev == store.Dir {
 		c.respond(t, Valid|Done, nil, readonly)
 		return
 	}
@@ -441,6 +539,9 @@ func (c *conn) set(t *T, tx txn) {
 				c.respond(t, Valid|Done, nil, revMismatch)
 				return
 			case nil:
+				if pb.GetBool(t.Ephemeral) {
+					c.markEphemeral(*t.Path)
+				}
 				c.respond(t, Valid|Done, nil, &R{Rev: &ev.Seqn})
 				return
 			}
@@ -591,65 +692,7 @@ func (c *conn) cancel(t *T, tx txn) {
 }
 
 
-func (c *conn) watch(t *T, tx txn) {
-	pat := pb.GetString(t.Path)
-	glob, err := store.CompileGlob(pat)
-	if err != nil {
-		c.respond(t, Valid|Done, nil, errResponse(err))
-		return
-	}
-
-	var w *store.Watch
-	rev := pb.GetInt64(t.Rev)
-	if rev == 0 {
-		w, err = store.NewWatch(c.s.St, glob), nil
-	} else {
-		w, err = store.NewWatchFrom(c.s.St, glob, rev)
-	}
-
-	switch err {
-	case nil:
-		// nothing
-	case store.ErrTooLate:
-		c.respond(t, Valid|Done, nil, tooLate)
-	default:
-		c.respond(t, Valid|Done, nil, errResponse(err))
-	}
-
-	go func() {
-		defer w.Stop()
-
-		// TODO buffer (and possibly discard) events
-		for {
-			select {
-			case ev := <-w.C:
-				if closed(w.C) {
-					return
-				}
-
-				r := R{
-					Path:  &ev.Path,
-					Value: []byte(ev.Body),
-					Rev:   &ev.Seqn,
-				}
-
-				var flag int32
-				switch {
-				case ev.IsSet():
-					flag = Set
-				case ev.IsDel():
-					flag = Del
-				}
-
-				c.respond(t, Valid|flag, tx.cancel, &r)
-
-			case <-tx.cancel:
-				c.closeTxn(*t.Tag)
-				return
-			}
-		}
-	}()
-}
+// conn.watch is implemented in watch.go.
 
 
 func (c *conn) walk(t *T, tx txn) {
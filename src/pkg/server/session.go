@@ -0,0 +1,222 @@
+package server
+
+import (
+	"doozer/consensus"
+	"doozer/store"
+	"strconv"
+	"strings"
+	"time"
+)
+
+
+// A session lives under /ctl/session/<sid>/*, giving doozer a
+// Chubby/ZK-style ephemeral-node primitive:
+//
+//	/ctl/session/<sid>/expiry            ns, refreshed by activity
+//	/ctl/session/<sid>/closed             set on a graceful conn.serve exit
+//	/ctl/session/<sid>/ephemeral/<flat>   original path of an owned key
+//
+// sid is derived from a proposal's seqn, so it's unique cluster-wide.
+
+
+func sessionPath(sid int32) string {
+	return "/ctl/session/" + strconv.Itoa(int(sid))
+}
+
+
+// flattenPath turns a store path into a single path segment suitable as
+// a key under .../ephemeral/.
+func flattenPath(path string) string {
+	return strings.Replace(path, "/", "\x00", -1)
+}
+
+
+// ensureSession lazily assigns this conn a session id and starts its
+// lease keepalive. It is idempotent and safe to call on every request.
+// The bgNop consensus round must not run with c.slk held, or it would
+// stall touchSession and every other request on this conn until it
+// completes.
+func (c *conn) ensureSession() int32 {
+	c.slk.RLock()
+	sid := c.sid
+	c.slk.RUnlock()
+	if sid != 0 {
+		return sid
+	}
+
+	ev := <-bgNop(c.s.Mg)
+	sid = int32(ev.Seqn)
+
+	c.slk.Lock()
+	if c.sid != 0 {
+		// Lost the race with another call; someone else already
+		// finished allocating a session while bgNop was in flight.
+		sid = c.sid
+		c.slk.Unlock()
+		return sid
+	}
+	c.sid = sid
+	c.lastActive = time.Nanoseconds()
+	c.sessDone = make(chan bool)
+	c.slk.Unlock()
+
+	expiry := time.Nanoseconds() + sessionLease
+	go c.setLogged("session-expiry-propose", sessionPath(sid)+"/expiry", []byte(strconv.Itoa64(expiry)), store.Clobber)
+	go c.keepSessionAlive(sid, c.sessDone)
+
+	return sid
+}
+
+
+// touchSession marks this conn's session (if any) as active. Called on
+// every request, so NOP heartbeats keep a lease alive too.
+func (c *conn) touchSession() {
+	c.slk.Lock()
+	if c.sid != 0 {
+		c.lastActive = time.Nanoseconds()
+	}
+	c.slk.Unlock()
+}
+
+
+// leaseLapsed reports whether a conn has gone too long without activity
+// to keep renewing its lease.
+func leaseLapsed(now, lastActive int64) bool {
+	return now-lastActive > sessionLease
+}
+
+
+// keepSessionAlive refreshes sid's lease shortly before it would
+// expire, as long as the conn has seen recent activity; otherwise it
+// lets the lease lapse and returns.
+func (c *conn) keepSessionAlive(sid int32, done chan bool) {
+	for {
+		time.Sleep(sessionLease - sessionPad)
+
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		c.slk.RLock()
+		active := c.lastActive
+		c.slk.RUnlock()
+
+		if leaseLapsed(time.Nanoseconds(), active) {
+			return
+		}
+
+		expiry := time.Nanoseconds() + sessionLease
+		c.setLogged("session-expiry-propose", sessionPath(sid)+"/expiry", []byte(strconv.Itoa64(expiry)), store.Clobber)
+	}
+}
+
+
+// closeSession publishes a "closed" marker so the reaper drops this
+// session's ephemeral keys immediately instead of waiting out the lease.
+func (c *conn) closeSession() {
+	c.slk.RLock()
+	sid := c.sid
+	done := c.sessDone
+	c.slk.RUnlock()
+
+	if sid == 0 {
+		return
+	}
+
+	if done != nil {
+		close(done)
+	}
+
+	c.setLogged("session-close-propose", sessionPath(sid)+"/closed", []byte("1"), store.Clobber)
+}
+
+
+// markEphemeral records that this conn's session owns path, so the
+// reaper deletes it on expiry or close.
+func (c *conn) markEphemeral(path string) {
+	sid := c.ensureSession()
+	key := sessionPath(sid) + "/ephemeral/" + flattenPath(path)
+	go c.setLogged("session-ephemeral-propose", key, []byte(path), store.Clobber)
+}
+
+
+// setLogged proposes a best-effort Set (callers usually run it in its
+// own goroutine and do not wait on it) and logs a failed proposal
+// instead of discarding it; it does not retry.
+func (c *conn) setLogged(event, key string, value []byte, cas int64) {
+	ev := consensus.Set(c.s.Mg, key, value, cas)
+	if ev.Err != nil {
+		c.s.logger().Warn(event, "conn.addr", c.addr, "key", key, "err", ev.Err)
+	}
+}
+
+
+// expiryPassed reports whether a session's published expiry, plus the
+// grace pad, has passed.
+func expiryPassed(now, expiry int64) bool {
+	return now > expiry+sessionPad
+}
+
+
+// reapInterval is how often ReapSessions checks for expired or closed
+// sessions.
+const reapInterval = 1e9 // ns == 1s
+
+
+// ReapSessions periodically walks /ctl/session/*, and for every session
+// that's expired or published a "closed" marker, deletes its ephemeral
+// keys and then the session node itself. Runs until done is read.
+func (sv *Server) ReapSessions(done chan int) {
+	closedGlob := store.MustCompileGlob("/ctl/session/*/closed")
+	expiryGlob := store.MustCompileGlob("/ctl/session/*/expiry")
+	ephemeralGlob := store.MustCompileGlob("/ctl/session/*/ephemeral/*")
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		now := time.Nanoseconds()
+		_, g := sv.St.Snap()
+
+		expired := make(map[string]bool)
+
+		store.Walk(g, closedGlob, func(path, _ string, _ int64) bool {
+			expired[sessionDirOf(path)] = true
+			return false
+		})
+
+		store.Walk(g, expiryGlob, func(path, body string, _ int64) bool {
+			exp, err := strconv.Atoi64(body)
+			if err == nil && expiryPassed(now, exp) {
+				expired[sessionDirOf(path)] = true
+			}
+			return false
+		})
+
+		for sdir := range expired {
+			store.Walk(g, ephemeralGlob, func(path, body string, _ int64) bool {
+				if strings.HasPrefix(path, sdir+"/ephemeral/") {
+					<-bgDel(sv.Mg, body, store.Clobber)
+					<-bgDel(sv.Mg, path, store.Clobber)
+				}
+				return false
+			})
+			<-bgDel(sv.Mg, sdir+"/expiry", store.Clobber)
+			<-bgDel(sv.Mg, sdir+"/closed", store.Clobber)
+		}
+
+		time.Sleep(reapInterval)
+	}
+}
+
+
+// sessionDirOf returns "/ctl/session/<sid>" given any path underneath it.
+func sessionDirOf(path string) string {
+	parts := strings.Split(path, "/", -1)
+	return strings.Join(parts[:4], "/")
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+
+func TestSessionPath(t *testing.T) {
+	if got, want := sessionPath(42), "/ctl/session/42"; got != want {
+		t.Errorf("sessionPath(42) = %q, want %q", got, want)
+	}
+}
+
+
+func TestFlattenPathIsReversibleInPractice(t *testing.T) {
+	in := "/foo/bar/baz"
+	flat := flattenPath(in)
+	if flat == in {
+		t.Fatal("flattenPath did not change a path containing slashes")
+	}
+	if back := strings.Replace(flat, "\x00", "/", -1); back != in {
+		t.Fatalf("unflattening %q gave %q, want %q", flat, back, in)
+	}
+
+	// The ephemeral leaf's body holds the original path verbatim, so the
+	// reaper never needs to unflatten the key itself.
+}
+
+
+func TestSessionDirOf(t *testing.T) {
+	cases := map[string]string{
+		"/ctl/session/42/expiry":                 "/ctl/session/42",
+		"/ctl/session/42/closed":                 "/ctl/session/42",
+		"/ctl/session/42/ephemeral/\x00foo\x00bar": "/ctl/session/42",
+	}
+
+	for path, want := range cases {
+		if got := sessionDirOf(path); got != want {
+			t.Errorf("sessionDirOf(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+
+// TestLeaseLapsedRequiresSilenceLongerThanLease exercises the branch
+// keepSessionAlive uses to decide whether to keep renewing a lease or
+// let it expire: it must not give up at exactly sessionLease of
+// silence, only once that's been exceeded.
+func TestLeaseLapsedRequiresSilenceLongerThanLease(t *testing.T) {
+	const lastActive = int64(1e15)
+
+	if leaseLapsed(lastActive, lastActive) {
+		t.Fatal("lapsed immediately after activity")
+	}
+	if leaseLapsed(lastActive+sessionLease, lastActive) {
+		t.Fatal("lapsed at exactly sessionLease of silence, want strictly greater")
+	}
+	if !leaseLapsed(lastActive+sessionLease+1, lastActive) {
+		t.Fatal("expected lapsed just past sessionLease of silence")
+	}
+}
+
+
+// TestExpiryPassedHonorsGracePad exercises the branch ReapSessions uses
+// to decide whether a published expiry has actually passed: the pad
+// gives a slow keepSessionAlive refresh a little room before the
+// session is reclaimed.
+func TestExpiryPassedHonorsGracePad(t *testing.T) {
+	const expiry = int64(1e15)
+
+	if expiryPassed(expiry, expiry) {
+		t.Fatal("passed immediately at the recorded expiry, want the pad honored")
+	}
+	if expiryPassed(expiry+sessionPad, expiry) {
+		t.Fatal("passed at exactly expiry+pad, want strictly greater")
+	}
+	if !expiryPassed(expiry+sessionPad+1, expiry) {
+		t.Fatal("expected passed just beyond expiry+pad")
+	}
+}
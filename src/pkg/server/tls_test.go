@@ -0,0 +1,172 @@
+package server
+
+import (
+	"big"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+)
+
+// genCert returns a self-signed certificate/key pair usable as a
+// tls.Certificate, optionally signed as a CA (for building a ClientCAs pool).
+func genCert(t *testing.T, cn string, isCA bool) tls.Certificate {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         isCA,
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+
+// serveOneTLS starts a real *Server with TLSConfig set, listening on an
+// ephemeral port, and returns its address and the fakeLogger it's
+// wired to, so a test can dial through the actual Serve/conn machinery
+// (handshake wrapping, tlsState, close-on-failure) instead of rolling
+// its own TLS accept loop.
+func serveOneTLS(t *testing.T, cfg *tls.Config) (addr string, fl *fakeLogger) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fl = &fakeLogger{}
+	s := &Server{TLSConfig: cfg, Logger: fl}
+	cal := make(chan bool)
+	close(cal)
+
+	go s.Serve(l, cal)
+
+	return l.Addr().String(), fl
+}
+
+
+// waitForWarn polls fl for a Warn-level call with the given event, long
+// enough for a handshake failure on the other end of a loopback
+// connection to be observed and logged.
+func waitForWarn(fl *fakeLogger, event string) bool {
+	for i := 0; i < 100; i++ {
+		for _, c := range fl.calls {
+			if c.level == "WARN" && c.event == event {
+				return true
+			}
+		}
+		time.Sleep(10e6) // 10ms
+	}
+	return false
+}
+
+
+// waitForEOF reads from c in a goroutine and reports whether it sees an
+// error (EOF or otherwise) within a short timeout, i.e. whether the
+// peer closed the connection rather than leaving it open.
+func waitForEOF(c net.Conn) bool {
+	done := make(chan bool, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := c.Read(buf)
+		done <- err != nil
+	}()
+
+	select {
+	case ok := <-done:
+		return ok
+	case <-time.After(1e9):
+		return false
+	}
+}
+
+
+func TestTLSRejectsMissingClientCert(t *testing.T) {
+	srvCert := genCert(t, "doozer-node", false)
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{srvCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+
+	addr, fl := serveOneTLS(t, cfg)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := cc.Handshake(); err == nil {
+		t.Fatal("expected client handshake to fail for a client with no certificate")
+	}
+
+	// Serve should have closed its side on the failed handshake rather
+	// than handing the conn to conn.serve; confirm the raw socket was
+	// dropped, not left open waiting for requests.
+	if !waitForEOF(conn) {
+		t.Fatal("expected server to close the connection after the failed handshake")
+	}
+
+	if !waitForWarn(fl, "tls-handshake") {
+		t.Fatalf("log calls = %+v, want a tls-handshake Warn event", fl.calls)
+	}
+}
+
+
+func TestTLSRejectsUntrustedClientCert(t *testing.T) {
+	srvCert := genCert(t, "doozer-node", false)
+	untrusted := genCert(t, "someone-else", false)
+
+	caPool := x509.NewCertPool()
+	// Intentionally do not add `untrusted` to the pool.
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{srvCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    caPool,
+	}
+
+	addr, fl := serveOneTLS(t, cfg)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{untrusted},
+	})
+	if err := cc.Handshake(); err == nil {
+		t.Fatal("expected client handshake to fail for an untrusted client certificate")
+	}
+
+	if !waitForEOF(conn) {
+		t.Fatal("expected server to close the connection after the failed handshake")
+	}
+
+	if !waitForWarn(fl, "tls-handshake") {
+		t.Fatalf("log calls = %+v, want a tls-handshake Warn event", fl.calls)
+	}
+}
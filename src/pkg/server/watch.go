@@ -0,0 +1,244 @@
+package server
+
+import (
+	"doozer/proto"
+	"doozer/store"
+	"strconv"
+	"sync"
+
+	pb "goprotobuf.googlecode.com/hg/proto"
+)
+
+
+var overflow = &R{ErrCode: proto.NewResponse_Err(proto.Response_OVERFLOW)}
+
+
+// watchBuf is a bounded, coalescing ring buffer between the store
+// reader goroutine (must never block) and the conn writer goroutine.
+// Events for the same path are coalesced to their newest rev; once
+// that's not enough to stay under cap, the oldest distinct path drops.
+type watchBuf struct {
+	cap   int
+	mu    sync.Mutex
+	order []string
+	latest map[string]store.Event
+	avail  chan bool
+
+	dropped   int64
+	coalesced int64
+	highWater int64
+
+	lastRev int64
+}
+
+
+func newWatchBuf(cap int) *watchBuf {
+	return &watchBuf{
+		cap:    cap,
+		latest: make(map[string]store.Event),
+		avail:  make(chan bool, 1),
+	}
+}
+
+
+func (b *watchBuf) push(ev store.Event) {
+	b.mu.Lock()
+	if _, ok := b.latest[ev.Path]; ok {
+		b.coalesced++
+	} else {
+		if len(b.order) >= b.cap {
+			oldest := b.order[0]
+			b.order = b.order[1:]
+			b.latest[oldest] = store.Event{}, false
+			b.dropped++
+		}
+		b.order = append(b.order, ev.Path)
+	}
+	b.latest[ev.Path] = ev
+	if int64(len(b.order)) > b.highWater {
+		b.highWater = int64(len(b.order))
+	}
+	b.mu.Unlock()
+
+	select {
+	case b.avail <- true:
+	default:
+	}
+}
+
+
+// pop returns the oldest pending event, or ok == false if the buffer is
+// empty.
+func (b *watchBuf) pop() (ev store.Event, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.order) == 0 {
+		return store.Event{}, false
+	}
+
+	path := b.order[0]
+	b.order = b.order[1:]
+	ev, ok = b.latest[path], true
+	b.latest[path] = store.Event{}, false
+	b.lastRev = ev.Seqn
+	return ev, ok
+}
+
+
+// overflowed reports whether this buffer has dropped (not just
+// coalesced) at least a full cap's worth of events.
+func (b *watchBuf) overflowed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped >= int64(b.cap)
+}
+
+
+// lastSeenRev returns the rev of the most recent event pop has returned.
+func (b *watchBuf) lastSeenRev() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastRev
+}
+
+
+func (b *watchBuf) stats() (dropped, coalesced, highWater int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped, b.coalesced, b.highWater
+}
+
+
+// publishStats writes this watch's counters to the store under
+// /ctl/conn/<addr>/watch/<tag>/* so operators can observe slow
+// consumers. It is best-effort: only a CAL node can propose, and a
+// failed proposal is logged via setLogged but not retried.
+func (c *conn) publishWatchStats(tag int32, b *watchBuf) {
+	if !c.cal {
+		return
+	}
+
+	dropped, coalesced, highWater := b.stats()
+	base := "/ctl/conn/" + c.addr + "/watch/" + strconv.Itoa(int(tag)) + "/"
+	go c.setLogged("watch-stats-propose", base+"dropped", []byte(strconv.Itoa64(dropped)), store.Clobber)
+	go c.setLogged("watch-stats-propose", base+"coalesced", []byte(strconv.Itoa64(coalesced)), store.Clobber)
+	go c.setLogged("watch-stats-propose", base+"high-water", []byte(strconv.Itoa64(highWater)), store.Clobber)
+}
+
+
+func (c *conn) watch(t *T, tx txn) {
+	pat := pb.GetString(t.Path)
+	glob, err := store.CompileGlob(pat)
+	if err != nil {
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
+	}
+
+	var w *store.Watch
+	rev := pb.GetInt64(t.Rev)
+	if rev == 0 {
+		w, err = store.NewWatch(c.s.St, glob), nil
+	} else {
+		w, err = store.NewWatchFrom(c.s.St, glob, rev)
+	}
+
+	switch err {
+	case nil:
+		// nothing
+	case store.ErrTooLate:
+		c.respond(t, Valid|Done, nil, tooLate)
+		return
+	default:
+		c.respond(t, Valid|Done, nil, errResponse(err))
+		return
+	}
+
+	tag := pb.GetInt32(t.Tag)
+	buf := newWatchBuf(c.s.watchBufSize())
+
+	stop := make(chan bool)
+	var stopOnce sync.Once
+	// tx.cancel is read by both goroutines below, so a single cancel is
+	// delivered to only one of them; closeTxn lives here instead so it
+	// always fires regardless of which one wins that race.
+	closeStop := func() {
+		stopOnce.Do(func() {
+			c.closeTxn(*t.Tag)
+			close(stop)
+		})
+	}
+
+	// Reader: drains the store watch into buf, never blocking on the
+	// client. On overflow it just stops reading and returns; the writer
+	// owns draining the rest of buf and sending OVERFLOW.
+	go func() {
+		defer w.Stop()
+		for {
+			select {
+			case ev := <-w.C:
+				if closed(w.C) {
+					closeStop()
+					return
+				}
+				buf.push(ev)
+				if buf.overflowed() {
+					return
+				}
+			case <-tx.cancel:
+				closeStop()
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Writer: drains buf to the socket at whatever rate the client can
+	// absorb, checking for overflow only after each drain empties buf.
+	go func() {
+		defer c.publishWatchStats(tag, buf)
+		for {
+			select {
+			case <-buf.avail:
+				for {
+					ev, ok := buf.pop()
+					if !ok {
+						break
+					}
+
+					r := R{
+						Path:  &ev.Path,
+						Value: []byte(ev.Body),
+						Rev:   &ev.Seqn,
+					}
+
+					var flag int32
+					switch {
+					case ev.IsSet():
+						flag = Set
+					case ev.IsDel():
+						flag = Del
+					}
+
+					c.respond(t, Valid|flag, tx.cancel, &r)
+				}
+
+				if buf.overflowed() {
+					lastRev := buf.lastSeenRev()
+					c.respond(t, Valid|Done, nil, &R{
+						ErrCode:   overflow.ErrCode,
+						ErrDetail: overflow.ErrDetail,
+						Rev:       &lastRev,
+					})
+					closeStop()
+					return
+				}
+			case <-tx.cancel:
+				closeStop()
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
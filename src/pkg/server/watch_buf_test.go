@@ -0,0 +1,101 @@
+package server
+
+import (
+	"doozer/store"
+	"testing"
+)
+
+
+func TestWatchBufCoalescesSamePath(t *testing.T) {
+	b := newWatchBuf(4)
+
+	b.push(store.Event{Path: "/a", Seqn: 1})
+	b.push(store.Event{Path: "/a", Seqn: 2})
+	b.push(store.Event{Path: "/a", Seqn: 3})
+
+	dropped, coalesced, _ := b.stats()
+	if dropped != 0 {
+		t.Fatalf("dropped = %d, want 0", dropped)
+	}
+	if coalesced != 2 {
+		t.Fatalf("coalesced = %d, want 2", coalesced)
+	}
+
+	ev, ok := b.pop()
+	if !ok {
+		t.Fatal("pop: buffer unexpectedly empty")
+	}
+	if ev.Seqn != 3 {
+		t.Fatalf("pop: got seqn %d, want 3 (the newest rev for /a)", ev.Seqn)
+	}
+
+	if _, ok := b.pop(); ok {
+		t.Fatal("pop: expected buffer to be empty after draining the coalesced entry")
+	}
+}
+
+
+func TestWatchBufDropsOldestDistinctPathWhenFull(t *testing.T) {
+	b := newWatchBuf(2)
+
+	b.push(store.Event{Path: "/a", Seqn: 1})
+	b.push(store.Event{Path: "/b", Seqn: 2})
+	b.push(store.Event{Path: "/c", Seqn: 3}) // forces /a out
+
+	dropped, _, highWater := b.stats()
+	if dropped != 1 {
+		t.Fatalf("dropped = %d, want 1", dropped)
+	}
+	if highWater != 2 {
+		t.Fatalf("highWater = %d, want 2", highWater)
+	}
+
+	ev, ok := b.pop()
+	if !ok || ev.Path != "/b" {
+		t.Fatalf("pop: got %+v, want /b (oldest surviving entry)", ev)
+	}
+}
+
+
+func TestWatchBufOverflowsAfterDroppingACapsWorth(t *testing.T) {
+	b := newWatchBuf(2)
+
+	if b.overflowed() {
+		t.Fatal("overflowed before any drops")
+	}
+
+	b.push(store.Event{Path: "/a", Seqn: 1})
+	b.push(store.Event{Path: "/b", Seqn: 2})
+	b.push(store.Event{Path: "/c", Seqn: 3}) // drops /a
+	b.push(store.Event{Path: "/d", Seqn: 4}) // drops /b
+
+	if !b.overflowed() {
+		t.Fatal("expected buffer to report overflow after dropping a cap's worth of entries")
+	}
+}
+
+
+func TestWatchBufLastSeenRevTracksPop(t *testing.T) {
+	b := newWatchBuf(4)
+
+	if b.lastSeenRev() != 0 {
+		t.Fatalf("lastSeenRev = %d, want 0 before any pop", b.lastSeenRev())
+	}
+
+	b.push(store.Event{Path: "/a", Seqn: 1})
+	b.push(store.Event{Path: "/b", Seqn: 2})
+
+	if _, ok := b.pop(); !ok {
+		t.Fatal("pop: buffer unexpectedly empty")
+	}
+	if b.lastSeenRev() != 1 {
+		t.Fatalf("lastSeenRev = %d, want 1 after popping /a", b.lastSeenRev())
+	}
+
+	if _, ok := b.pop(); !ok {
+		t.Fatal("pop: buffer unexpectedly empty")
+	}
+	if b.lastSeenRev() != 2 {
+		t.Fatalf("lastSeenRev = %d, want 2 after popping /b", b.lastSeenRev())
+	}
+}